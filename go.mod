@@ -4,5 +4,6 @@ go 1.13
 
 require (
 	github.com/coreos/go-systemd/v22 v22.1.0
+	github.com/godbus/dbus/v5 v5.0.3
 	github.com/influxdata/telegraf v1.15.3
 )
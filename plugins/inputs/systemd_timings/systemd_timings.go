@@ -1,12 +1,18 @@
 package systemd_timings
 
 import (
+	"bufio"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-systemd/v22/dbus"
 	"github.com/influxdata/telegraf"
+	"github.com/influxdata/telegraf/metric"
 	"github.com/influxdata/telegraf/plugins/inputs"
 )
 
@@ -14,6 +20,40 @@ import (
 type SystemdTimings struct {
 	UnitPattern string `toml:"unitpattern"`
 	Periodic    bool   `toml:"periodic"`
+
+	IncludeProcMetrics       bool `toml:"includeprocmetrics"`
+	IncludeServiceProperties bool `toml:"includeserviceproperties"`
+	IncludeSocketProperties  bool `toml:"includesocketproperties"`
+	CollectMountDetails      bool `toml:"collectmountdetails"`
+	TrackStateChanges        bool `toml:"trackstatechanges"`
+
+	MaxUndeliveredMetrics int `toml:"maxundeliveredmetrics"`
+
+	// Record if we've collected everything (and thus do not need to collect
+	// again).
+	collectionDone bool
+
+	// Tracking IDs of metrics which have been sent via a tracking
+	// accumulator but which have not yet been confirmed as delivered, mapped
+	// to an optional function to call once delivery succeeds.
+	pendingDeliveries map[telegraf.TrackingID]func()
+
+	// Set if any tracked metric failed delivery, in which case everything is
+	// collected again once all outstanding deliveries have been resolved.
+	deliveryFailed bool
+
+	// Last seen reload timestamp of each service, keyed by unit name.
+	reloadTimestamps sync.Map
+}
+
+// dbusConnection is the subset of the systemd dbus API used by this plugin.
+type dbusConnection interface {
+	GetManagerProperty(propName string) (string, error)
+	GetUnitProperty(unitName string, propName string) (*dbus.Property, error)
+	GetUnitTypeProperty(unitName string, unitType string,
+		propName string) (*dbus.Property, error)
+	ListUnitsByPatterns(states []string,
+		patterns []string) ([]dbus.UnitStatus, error)
 }
 
 // Measurement name.
@@ -25,8 +65,27 @@ const defaultUnitPattern = "*.service"
 // Only run once by default.
 const defaultPeriodic = false
 
-// Record if we've collected everything (and thus do not need to collect again)
-var collectionDone = false
+// Don't read per process metrics from procfs by default.
+const defaultIncludeProcMetrics = false
+
+// Don't read service configuration properties by default.
+const defaultIncludeServiceProperties = false
+
+// Don't read socket configuration properties by default.
+const defaultIncludeSocketProperties = false
+
+// Don't report mount unit details by default.
+const defaultCollectMountDetails = false
+
+// Don't track unit state changes by default.
+const defaultTrackStateChanges = false
+
+// Maximum number of tracked metrics awaiting delivery by default, this must
+// not exceed the number of metrics the tracking accumulator was created for.
+const defaultMaxUndeliveredMetrics = 1000
+
+// Root of the proc filesystem, tests point this elsewhere.
+var procPath = "/proc"
 
 // Map of a system wide boot metrics to their timestamps in microseconds, see:
 // https://www.freedesktop.org/wiki/Software/systemd/dbus/ for more details.
@@ -50,6 +109,14 @@ var managerProps = map[string]string{
 	"InitRDUnitsLoadFinishTimestampMonotonic":  "",
 }
 
+// Map of IOSchedulingClass values to their names, see ioprio_set(2).
+var ioSchedulingClasses = map[int32]string{
+	0: "none",
+	1: "realtime",
+	2: "best-effort",
+	3: "idle",
+}
+
 // stripType removes the dbus type from the string str to return only the value.
 // See https://www.alteeve.com/w/List_of_DBus_data_types for dbus type
 // information.
@@ -58,7 +125,7 @@ func stripType(str string) string {
 }
 
 // getManagerProp retrieves the property value with name propName.
-func getManagerProp(dbusConn *dbus.Conn, propName string) (string, error) {
+func getManagerProp(dbusConn dbusConnection, propName string) (string, error) {
 	prop, err := dbusConn.GetManagerProperty(propName)
 	if err != nil {
 		return "", err
@@ -93,9 +160,94 @@ func bootIsFinished() bool {
 	return progressVal != 0
 }
 
+// handleDelivery records the delivery result of a tracked metric.
+func (s *SystemdTimings) handleDelivery(info telegraf.DeliveryInfo) {
+	onDelivered, found := s.pendingDeliveries[info.ID()]
+	if !found {
+		// Not one of ours.
+		return
+	}
+
+	delete(s.pendingDeliveries, info.ID())
+	if !info.Delivered() {
+		s.deliveryFailed = true
+		return
+	}
+
+	if onDelivered != nil {
+		onDelivered()
+	}
+}
+
+// addFields sends a metric to telegraf.  If the accumulator supports tracking
+// then the metric is sent as a tracking metric and its delivery is recorded as
+// pending until telegraf confirms it.  At most MaxUndeliveredMetrics tracked
+// metrics are pending at once, beyond that we block until telegraf confirms
+// delivery of an earlier metric since the tracking accumulator panics if its
+// delivery channel overflows.  If onDelivered is not nil it is called once
+// the metric has been sent, or for tracked metrics once delivery succeeds.
+func (s *SystemdTimings) addFields(acc telegraf.Accumulator,
+	fields map[string]interface{},
+	tags map[string]string,
+	onDelivered func()) {
+	tacc, ok := acc.(telegraf.TrackingAccumulator)
+	if !ok {
+		acc.AddFields(measurement, fields, tags)
+		if onDelivered != nil {
+			onDelivered()
+		}
+		return
+	}
+
+	m, err := metric.New(measurement, tags, fields, time.Now())
+	if err != nil {
+		acc.AddError(err)
+		return
+	}
+
+	if s.pendingDeliveries == nil {
+		s.pendingDeliveries = make(map[telegraf.TrackingID]func())
+	}
+
+	maxUndelivered := s.MaxUndeliveredMetrics
+	if maxUndelivered <= 0 {
+		maxUndelivered = defaultMaxUndeliveredMetrics
+	}
+
+	for len(s.pendingDeliveries) >= maxUndelivered {
+		s.handleDelivery(<-tacc.Delivered())
+	}
+
+	s.pendingDeliveries[tacc.AddTrackingMetric(m)] = onDelivered
+}
+
+// readDeliveries consumes any delivery confirmations which are available
+// without blocking.  Once every pending metric has been resolved the
+// collection is marked as done, unless a delivery failed in which case the
+// next Gather call will collect everything again.
+func (s *SystemdTimings) readDeliveries(acc telegraf.TrackingAccumulator) {
+	for len(s.pendingDeliveries) > 0 {
+		select {
+		case info := <-acc.Delivered():
+			s.handleDelivery(info)
+		default:
+			return
+		}
+	}
+
+	if s.deliveryFailed {
+		s.deliveryFailed = false
+		return
+	}
+
+	s.collectionDone = true
+}
+
 // postAllManagerProps reads all systemd manager properties and sends them to
 // telegraf.
-func postAllManagerProps(dbusConn *dbus.Conn, acc telegraf.Accumulator) error {
+func postAllManagerProps(dbusConn dbusConnection,
+	acc telegraf.Accumulator,
+	s *SystemdTimings) error {
 
 	// Read all properties and send non zero values to telegraf.
 	for name := range managerProps {
@@ -124,7 +276,7 @@ func postAllManagerProps(dbusConn *dbus.Conn, acc telegraf.Accumulator) error {
 			fields := map[string]interface{}{"SystemTimestampValue": value}
 
 			// Send to telegraf.
-			acc.AddFields(measurement, fields, tags)
+			s.addFields(acc, fields, tags, nil)
 		}
 	}
 
@@ -133,7 +285,7 @@ func postAllManagerProps(dbusConn *dbus.Conn, acc telegraf.Accumulator) error {
 
 // query dbus to access unit startup timing data, all time measurements here
 // are measured in microseconds.
-func getUnitTimingData(dbusConn *dbus.Conn,
+func getUnitTimingData(dbusConn dbusConnection,
 	unitName string,
 	userSpaceStart uint64) (uint64, uint64, uint64, uint64, uint64, error) {
 
@@ -215,8 +367,142 @@ func getUnitTimingData(dbusConn *dbus.Conn,
 	return activating, activated, deactivating, deactivated, runtime, nil
 }
 
+// getServiceMainPID returns the PID of the main process of the service
+// unitName, zero is returned if the service has no running main process.
+func getServiceMainPID(dbusConn dbusConnection, unitName string) (uint32, error) {
+	prop, err := dbusConn.GetUnitTypeProperty(unitName, "Service",
+		"ExecMainPID")
+	if err != nil {
+		return 0, err
+	}
+
+	pid, ok := prop.Value.Value().(uint32)
+	if !ok {
+		return 0, fmt.Errorf("unexpected ExecMainPID type for %s: %s",
+			unitName, prop.Value.Signature())
+	}
+
+	return pid, nil
+}
+
+// getIOSchedulingClass returns the name of the effective I/O scheduling class
+// of the service unitName.  systemd reports a class for every service, whether
+// or not IOSchedulingClass= is set in its unit file.
+func getIOSchedulingClass(dbusConn dbusConnection,
+	unitName string) (string, error) {
+	prop, err := dbusConn.GetUnitTypeProperty(unitName, "Service",
+		"IOSchedulingClass")
+	if err != nil {
+		return "", err
+	}
+
+	class, ok := prop.Value.Value().(int32)
+	if !ok {
+		return "", fmt.Errorf("unexpected IOSchedulingClass type for %s: %s",
+			unitName, prop.Value.Signature())
+	}
+
+	name, found := ioSchedulingClasses[class]
+	if !found {
+		return "", fmt.Errorf("unknown IOSchedulingClass for %s: %d",
+			unitName, class)
+	}
+
+	return name, nil
+}
+
+// getSocketPassCredentials returns true if the socket unitName has
+// PassCredentials enabled.
+func getSocketPassCredentials(dbusConn dbusConnection,
+	unitName string) (bool, error) {
+	prop, err := dbusConn.GetUnitTypeProperty(unitName, "Socket",
+		"PassCredentials")
+	if err != nil {
+		return false, err
+	}
+
+	passCredentials, ok := prop.Value.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("unexpected PassCredentials type for %s: %s",
+			unitName, prop.Value.Signature())
+	}
+
+	return passCredentials, nil
+}
+
+// getReloadTimestamp returns the monotonic timestamp at which the most recent
+// reload of the service unitName finished, zero is returned if the service
+// has never been reloaded.  The timestamp is read from the ExecReload
+// property, an array of (path, argv, ignore_errors, start_time,
+// start_time_monotonic, exit_time, exit_time_monotonic, pid, code, status)
+// structures, one per reload command.
+func getReloadTimestamp(dbusConn dbusConnection,
+	unitName string) (uint64, error) {
+	prop, err := dbusConn.GetUnitTypeProperty(unitName, "Service",
+		"ExecReload")
+	if err != nil {
+		return 0, err
+	}
+
+	commands, ok := prop.Value.Value().([][]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected ExecReload type for %s: %s",
+			unitName, prop.Value.Signature())
+	}
+
+	reloaded := uint64(0)
+	for _, command := range commands {
+		if len(command) < 7 {
+			return 0, fmt.Errorf("unexpected ExecReload length for %s: %d",
+				unitName, len(command))
+		}
+
+		exited, ok := command[6].(uint64)
+		if !ok {
+			return 0, fmt.Errorf("unexpected ExecReload exit timestamp "+
+				"type for %s", unitName)
+		}
+
+		if exited > reloaded {
+			reloaded = exited
+		}
+	}
+
+	return reloaded, nil
+}
+
+// getProcMemoryHWM reads the peak resident set size, in kilobytes, of the
+// process pid from /proc/{pid}/status.
+func getProcMemoryHWM(pid uint32) (uint64, error) {
+	statusPath := filepath.Join(procPath, strconv.FormatUint(uint64(pid), 10),
+		"status")
+	file, err := os.Open(statusPath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	// The line of interest looks like "VmHWM:      1234 kB".
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "VmHWM:" {
+			continue
+		}
+
+		return strconv.ParseUint(fields[1], 10, 64)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("VmHWM not found in %s", statusPath)
+}
+
 // postAllUnitTimingData
-func postAllUnitTimingData(dbusConn *dbus.Conn,
+func postAllUnitTimingData(dbusConn dbusConnection,
 	acc telegraf.Accumulator,
 	s *SystemdTimings) error {
 	statusList, err := dbusConn.ListUnitsByPatterns([]string{},
@@ -241,6 +527,13 @@ func postAllUnitTimingData(dbusConn *dbus.Conn,
 		return err
 	}
 
+	// Record all collected unit names so mount units can be matched with
+	// their automount units.
+	unitNames := make(map[string]bool, len(statusList))
+	for _, unitStatus := range statusList {
+		unitNames[unitStatus.Name] = true
+	}
+
 	// For each unit query timing data, don't stop on failure.
 	for _, unitStatus := range statusList {
 		activating, activated, deactivating, deactivated, runtime, err :=
@@ -257,6 +550,9 @@ func postAllUnitTimingData(dbusConn *dbus.Conn,
 			// These are per unit wide timestamps, so tag them as such.
 			tags := map[string]string{"UnitName": unitStatus.Name}
 
+			// Called once the metric has been delivered, if set.
+			var onDelivered func()
+
 			// Construct fields map.
 			fields := map[string]interface{}{
 				"ActivatingTimestamp":   activating,
@@ -266,8 +562,78 @@ func postAllUnitTimingData(dbusConn *dbus.Conn,
 				"RunDuration":           runtime,
 			}
 
+			if s.IncludeProcMetrics &&
+				strings.HasSuffix(unitStatus.Name, ".service") {
+				pid, err := getServiceMainPID(dbusConn, unitStatus.Name)
+				if err != nil {
+					acc.AddError(err)
+				} else if pid > 0 {
+					hwm, err := getProcMemoryHWM(pid)
+					if os.IsNotExist(err) {
+						// The main process exited after we read its PID.
+					} else if err != nil {
+						acc.AddError(err)
+					} else {
+						fields["ExecMainMemoryHWM"] = hwm
+					}
+				}
+			}
+
+			if s.IncludeServiceProperties &&
+				strings.HasSuffix(unitStatus.Name, ".service") {
+				class, err := getIOSchedulingClass(dbusConn, unitStatus.Name)
+				if err != nil {
+					acc.AddError(err)
+				} else {
+					fields["IOSchedulerClass"] = class
+				}
+			}
+
+			if s.IncludeSocketProperties &&
+				strings.HasSuffix(unitStatus.Name, ".socket") {
+				passCredentials, err := getSocketPassCredentials(dbusConn,
+					unitStatus.Name)
+				if err != nil {
+					acc.AddError(err)
+				} else {
+					fields["SocketPassCredentials"] = passCredentials
+				}
+			}
+
+			if s.CollectMountDetails &&
+				strings.HasSuffix(unitStatus.Name, ".mount") {
+				// An automount unit has the same name as its mount unit
+				// but with an .automount suffix.
+				automount := strings.TrimSuffix(unitStatus.Name, ".mount") +
+					".automount"
+				fields["HasAutomount"] = unitNames[automount]
+			}
+
+			if s.TrackStateChanges &&
+				strings.HasSuffix(unitStatus.Name, ".service") {
+				reloaded, err := getReloadTimestamp(dbusConn, unitStatus.Name)
+				if err != nil {
+					acc.AddError(err)
+				} else if reloaded > 0 {
+					// Only report the reload timestamp when it differs from
+					// the one seen in the previous collection.
+					// The timestamp is only recorded once the metric has
+					// been delivered so that it is sent again if delivery
+					// fails.
+					unitName := unitStatus.Name
+					previous, found := s.reloadTimestamps.Load(unitName)
+					if !found || previous.(uint64) != reloaded {
+						fields["LastReloadTimestampUSec"] =
+							reloaded - userStartTs
+						onDelivered = func() {
+							s.reloadTimestamps.Store(unitName, reloaded)
+						}
+					}
+				}
+			}
+
 			// Send to telegraf.
-			acc.AddFields(measurement, fields, tags)
+			s.addFields(acc, fields, tags, onDelivered)
 		}
 	}
 
@@ -289,6 +655,29 @@ func (s *SystemdTimings) SampleConfig() string {
   # continuously send (potentially) the same data periodically then set
   # this configuration option to true.
   # periodic = false
+  ## Set to true to read per process metrics, such as the peak memory usage,
+  # of the main process of each running service from /proc.  Telegraf must
+  # run in the same PID namespace as systemd, otherwise the values are read
+  # from unrelated processes.
+  # includeprocmetrics = false
+  ## Set to true to report service configuration properties, such as the
+  # effective I/O scheduling class, for each service.
+  # includeserviceproperties = false
+  ## Set to true to report socket configuration properties, such as whether
+  # credential passing is enabled, for each socket.  Socket units must also
+  # match unitpattern.
+  # includesocketproperties = false
+  ## Set to true to report details, such as whether a mount is paired with an
+  # automount, for each mount.  Mount and automount units must also match
+  # unitpattern.
+  # collectmountdetails = false
+  ## Set to true to report changes in unit state between collections, such
+  # as the time at which a service was last reloaded.  Mostly useful with
+  # periodic = true.
+  # trackstatechanges = false
+  ## Maximum number of tracked metrics awaiting delivery, only used when the
+  # accumulator supports delivery tracking.
+  # maxundeliveredmetrics = 1000
 `
 }
 
@@ -301,13 +690,26 @@ func (s *SystemdTimings) Gather(acc telegraf.Accumulator) error {
 		return nil
 	}
 
+	if len(s.pendingDeliveries) > 0 {
+		// Check if telegraf has confirmed delivery of previously sent
+		// metrics.
+		if tacc, ok := acc.(telegraf.TrackingAccumulator); ok {
+			s.readDeliveries(tacc)
+		}
+	}
+
 	if s.Periodic == false {
 		// We only want to run once.
-		if collectionDone == true {
+		if s.collectionDone == true {
 			// By default we only collect once since these are generally boot
 			// time metrics.
 			return nil
 		}
+
+		if len(s.pendingDeliveries) > 0 {
+			// Still waiting on delivery of the last collection.
+			return nil
+		}
 	}
 
 	// Connect to the systemd dbus.
@@ -318,7 +720,7 @@ func (s *SystemdTimings) Gather(acc telegraf.Accumulator) error {
 
 	defer dbusConn.Close()
 
-	err = postAllManagerProps(dbusConn, acc)
+	err = postAllManagerProps(dbusConn, acc, s)
 	if err != nil {
 		acc.AddError(err)
 		return err
@@ -331,8 +733,10 @@ func (s *SystemdTimings) Gather(acc telegraf.Accumulator) error {
 		return err
 	}
 
-	if err == nil {
-		collectionDone = true
+	if err == nil && len(s.pendingDeliveries) == 0 {
+		// Tracked metrics mark the collection as done once delivery has been
+		// confirmed, see readDeliveries.
+		s.collectionDone = true
 	}
 
 	return err
@@ -343,6 +747,14 @@ func init() {
 		return &SystemdTimings{
 			UnitPattern: defaultUnitPattern,
 			Periodic:    defaultPeriodic,
+
+			IncludeProcMetrics:       defaultIncludeProcMetrics,
+			IncludeServiceProperties: defaultIncludeServiceProperties,
+			IncludeSocketProperties:  defaultIncludeSocketProperties,
+			CollectMountDetails:      defaultCollectMountDetails,
+			TrackStateChanges:        defaultTrackStateChanges,
+
+			MaxUndeliveredMetrics: defaultMaxUndeliveredMetrics,
 		}
 	})
 }
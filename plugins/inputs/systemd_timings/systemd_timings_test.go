@@ -1,9 +1,16 @@
 package systemd_timings
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/coreos/go-systemd/v22/dbus"
+	godbus "github.com/godbus/dbus/v5"
+	"github.com/influxdata/telegraf"
 	"github.com/influxdata/telegraf/testutil"
 )
 
@@ -50,3 +57,670 @@ func TestSystemdTiming(t *testing.T) {
 		}
 	})
 }
+
+// mockConn is a fake systemd dbus connection serving canned property values.
+// Unit type specific properties are keyed by "<unit type>.<property>", e.g.
+// "Service.ExecMainPID", so that tests fail if the wrong interface is queried.
+type mockConn struct {
+	managerProps map[string]uint64
+	unitProps    map[string]map[string]interface{}
+}
+
+func (c *mockConn) GetManagerProperty(propName string) (string, error) {
+	value, found := c.managerProps[propName]
+	if !found {
+		return "", fmt.Errorf("unknown manager property %s", propName)
+	}
+
+	return godbus.MakeVariant(value).String(), nil
+}
+
+func (c *mockConn) GetUnitProperty(unitName string,
+	propName string) (*dbus.Property, error) {
+	value, found := c.unitProps[unitName][propName]
+	if !found {
+		return nil, fmt.Errorf("unknown unit property %s", propName)
+	}
+
+	return &dbus.Property{Name: propName, Value: godbus.MakeVariant(value)},
+		nil
+}
+
+func (c *mockConn) GetUnitTypeProperty(unitName string, unitType string,
+	propName string) (*dbus.Property, error) {
+	value, found := c.unitProps[unitName][unitType+"."+propName]
+	if !found {
+		return nil, fmt.Errorf("unknown %s property %s", unitType, propName)
+	}
+
+	return &dbus.Property{Name: propName, Value: godbus.MakeVariant(value)},
+		nil
+}
+
+func (c *mockConn) ListUnitsByPatterns(states []string,
+	patterns []string) ([]dbus.UnitStatus, error) {
+	var statusList []dbus.UnitStatus
+	for name := range c.unitProps {
+		statusList = append(statusList, dbus.UnitStatus{Name: name})
+	}
+
+	return statusList, nil
+}
+
+func newMockConn() *mockConn {
+	return &mockConn{
+		managerProps: map[string]uint64{
+			"UserspaceTimestampMonotonic": 1000,
+			"FinishTimestampMonotonic":    9000,
+		},
+		unitProps: map[string]map[string]interface{}{
+			"foo.service": {
+				"InactiveExitTimestampMonotonic":  uint64(2000),
+				"ActiveEnterTimestampMonotonic":   uint64(3500),
+				"ActiveExitTimestampMonotonic":    uint64(0),
+				"InactiveEnterTimestampMonotonic": uint64(0),
+			},
+		},
+	}
+}
+
+// deliveryInfo is a fake telegraf.DeliveryInfo.
+type deliveryInfo struct {
+	id        telegraf.TrackingID
+	delivered bool
+}
+
+func (d *deliveryInfo) ID() telegraf.TrackingID {
+	return d.id
+}
+
+func (d *deliveryInfo) Delivered() bool {
+	return d.delivered
+}
+
+// trackingAccumulator is a telegraf.TrackingAccumulator which records the
+// tracking IDs it hands out so that tests can confirm their delivery.
+type trackingAccumulator struct {
+	testutil.Accumulator
+	ids       []telegraf.TrackingID
+	delivered chan telegraf.DeliveryInfo
+}
+
+func newTrackingAccumulator() *trackingAccumulator {
+	return &trackingAccumulator{
+		delivered: make(chan telegraf.DeliveryInfo, 100),
+	}
+}
+
+func (a *trackingAccumulator) AddTrackingMetric(
+	m telegraf.Metric) telegraf.TrackingID {
+	id := a.Accumulator.AddTrackingMetric(m)
+	a.ids = append(a.ids, id)
+	return id
+}
+
+func (a *trackingAccumulator) Delivered() <-chan telegraf.DeliveryInfo {
+	return a.delivered
+}
+
+// confirm simulates telegraf reporting the delivery result of all tracked
+// metrics.
+func (a *trackingAccumulator) confirm(delivered bool) {
+	for _, id := range a.ids {
+		a.delivered <- &deliveryInfo{id: id, delivered: delivered}
+	}
+
+	a.ids = nil
+}
+
+// agentAccumulator is a telegraf.TrackingAccumulator which behaves like the
+// telegraf agent's: metrics are delivered as soon as they are added and
+// results are sent on a channel sized to the maximum number of tracked
+// metrics, overflowing that channel panics.
+type agentAccumulator struct {
+	testutil.Accumulator
+	delivered chan telegraf.DeliveryInfo
+}
+
+func newAgentAccumulator(maxTracked int) *agentAccumulator {
+	return &agentAccumulator{
+		delivered: make(chan telegraf.DeliveryInfo, maxTracked),
+	}
+}
+
+func (a *agentAccumulator) AddTrackingMetric(
+	m telegraf.Metric) telegraf.TrackingID {
+	id := a.Accumulator.AddTrackingMetric(m)
+	select {
+	case a.delivered <- &deliveryInfo{id: id, delivered: true}:
+	default:
+		panic("channel is full")
+	}
+
+	return id
+}
+
+func (a *agentAccumulator) Delivered() <-chan telegraf.DeliveryInfo {
+	return a.delivered
+}
+
+// collect runs a single collection against the mock connection.
+func collect(t *testing.T, s *SystemdTimings, conn dbusConnection,
+	acc telegraf.Accumulator) {
+	if err := postAllManagerProps(conn, acc, s); err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+
+	if err := postAllUnitTimingData(conn, acc, s); err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+}
+
+func TestTrackingAccumulator(t *testing.T) {
+	t.Run("delivered", func(t *testing.T) {
+		systemdTimings := &SystemdTimings{UnitPattern: defaultUnitPattern}
+		acc := newTrackingAccumulator()
+		collect(t, systemdTimings, newMockConn(), acc)
+
+		if len(acc.ids) != 3 {
+			t.Errorf("expected 3 tracked metrics, got %d\n", len(acc.ids))
+		}
+
+		if len(systemdTimings.pendingDeliveries) != len(acc.ids) {
+			t.Errorf("expected %d pending deliveries, got %d\n",
+				len(acc.ids), len(systemdTimings.pendingDeliveries))
+		}
+
+		// Nothing confirmed yet.
+		systemdTimings.readDeliveries(acc)
+		if systemdTimings.collectionDone {
+			t.Errorf("collection done before delivery was confirmed\n")
+		}
+
+		acc.confirm(true)
+		systemdTimings.readDeliveries(acc)
+		if !systemdTimings.collectionDone {
+			t.Errorf("collection not done after delivery was confirmed\n")
+		}
+
+		if len(systemdTimings.pendingDeliveries) != 0 {
+			t.Errorf("unexpected pending deliveries: %d\n",
+				len(systemdTimings.pendingDeliveries))
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		systemdTimings := &SystemdTimings{UnitPattern: defaultUnitPattern}
+		acc := newTrackingAccumulator()
+		collect(t, systemdTimings, newMockConn(), acc)
+
+		acc.confirm(false)
+		systemdTimings.readDeliveries(acc)
+		if systemdTimings.collectionDone {
+			t.Errorf("collection done after delivery failed\n")
+		}
+
+		if systemdTimings.deliveryFailed {
+			t.Errorf("delivery failure not reset\n")
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		conn := newMockConn()
+		for i := 0; i < 10; i++ {
+			addMockUnit(conn, fmt.Sprintf("foo%d.service", i))
+		}
+
+		systemdTimings := &SystemdTimings{
+			UnitPattern:           defaultUnitPattern,
+			MaxUndeliveredMetrics: 2,
+		}
+		acc := newAgentAccumulator(2)
+		collect(t, systemdTimings, conn, acc)
+
+		if acc.NMetrics() != 13 {
+			t.Errorf("expected 13 metrics, got %d\n", acc.NMetrics())
+		}
+
+		if len(systemdTimings.pendingDeliveries) > 2 {
+			t.Errorf("expected at most 2 pending deliveries, got %d\n",
+				len(systemdTimings.pendingDeliveries))
+		}
+
+		systemdTimings.readDeliveries(acc)
+		if !systemdTimings.collectionDone {
+			t.Errorf("collection not done after delivery was confirmed\n")
+		}
+	})
+
+	t.Run("untracked", func(t *testing.T) {
+		systemdTimings := &SystemdTimings{UnitPattern: defaultUnitPattern}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, newMockConn(), untrackedAccumulator{acc})
+
+		if len(systemdTimings.pendingDeliveries) != 0 {
+			t.Errorf("unexpected pending deliveries: %d\n",
+				len(systemdTimings.pendingDeliveries))
+		}
+
+		acc.AssertContainsTaggedFields(t, measurement,
+			map[string]interface{}{
+				"ActivatingTimestamp":   uint64(1000),
+				"ActivatedTimestamp":    uint64(2500),
+				"DeactivatingTimestamp": uint64(0),
+				"DeactivatedTimestamp":  uint64(0),
+				"RunDuration":           uint64(1500),
+			},
+			map[string]string{"UnitName": "foo.service"})
+	})
+}
+
+// untrackedAccumulator hides the tracking methods of testutil.Accumulator.
+type untrackedAccumulator struct {
+	telegraf.Accumulator
+}
+
+// mockProcStatus writes a fake /proc/{pid}/status file with the given content
+// below a temporary proc root and returns the root.
+func mockProcStatus(t *testing.T, pid string, content string) string {
+	root, err := ioutil.TempDir("", "systemd_timings")
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+
+	if err := os.Mkdir(filepath.Join(root, pid), 0755); err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(root, pid, "status"),
+		[]byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed: %s\n", err)
+	}
+
+	return root
+}
+
+const mockStatus = `Name:	foo
+State:	S (sleeping)
+Pid:	1234
+VmPeak:	  123456 kB
+VmSize:	  123000 kB
+VmHWM:	    4321 kB
+VmRSS:	    4000 kB
+`
+
+func TestExecMainMemoryHWM(t *testing.T) {
+	root := mockProcStatus(t, "1234", mockStatus)
+	defer os.RemoveAll(root)
+
+	origProcPath := procPath
+	procPath = root
+	defer func() { procPath = origProcPath }()
+
+	t.Run("parse", func(t *testing.T) {
+		hwm, err := getProcMemoryHWM(1234)
+		if err != nil {
+			t.Errorf("failed: %s\n", err)
+		}
+
+		if hwm != 4321 {
+			t.Errorf("expected VmHWM 4321, got %d\n", hwm)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		missing := mockProcStatus(t, "42", "Name:\tfoo\nPid:\t42\n")
+		defer os.RemoveAll(missing)
+
+		procPath = missing
+		defer func() { procPath = root }()
+
+		if _, err := getProcMemoryHWM(42); err == nil {
+			t.Errorf("expected an error for a status without VmHWM\n")
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.ExecMainPID"] = uint32(1234)
+		systemdTimings := &SystemdTimings{IncludeProcMetrics: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if len(acc.Errors) != 0 {
+			t.Errorf("unexpected errors: %v\n", acc.Errors)
+		}
+
+		hwm, found := acc.Uint64Field(measurement, "ExecMainMemoryHWM")
+		if !found {
+			t.Errorf("ExecMainMemoryHWM not found\n")
+		} else if hwm != 4321 {
+			t.Errorf("expected ExecMainMemoryHWM 4321, got %d\n", hwm)
+		}
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.ExecMainPID"] = uint32(4321)
+		systemdTimings := &SystemdTimings{IncludeProcMetrics: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if len(acc.Errors) != 0 {
+			t.Errorf("unexpected errors: %v\n", acc.Errors)
+		}
+
+		if acc.HasField(measurement, "ExecMainMemoryHWM") {
+			t.Errorf("unexpected ExecMainMemoryHWM field\n")
+		}
+	})
+
+	t.Run("not running", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.ExecMainPID"] = uint32(0)
+		systemdTimings := &SystemdTimings{IncludeProcMetrics: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "ExecMainMemoryHWM") {
+			t.Errorf("unexpected ExecMainMemoryHWM field\n")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.ExecMainPID"] = uint32(1234)
+		systemdTimings := &SystemdTimings{}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "ExecMainMemoryHWM") {
+			t.Errorf("unexpected ExecMainMemoryHWM field\n")
+		}
+	})
+}
+
+func TestIOSchedulerClass(t *testing.T) {
+	classes := []struct {
+		value int32
+		name  string
+	}{
+		{0, "none"},
+		{1, "realtime"},
+		{2, "best-effort"},
+		{3, "idle"},
+	}
+
+	for _, class := range classes {
+		t.Run(class.name, func(t *testing.T) {
+			conn := newMockConn()
+			conn.unitProps["foo.service"]["Service.IOSchedulingClass"] = class.value
+			systemdTimings := &SystemdTimings{IncludeServiceProperties: true}
+			acc := new(testutil.Accumulator)
+			collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+			if len(acc.Errors) != 0 {
+				t.Errorf("unexpected errors: %v\n", acc.Errors)
+			}
+
+			name, found := acc.StringField(measurement, "IOSchedulerClass")
+			if !found {
+				t.Errorf("IOSchedulerClass not found\n")
+			} else if name != class.name {
+				t.Errorf("expected IOSchedulerClass %s, got %s\n",
+					class.name, name)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.IOSchedulingClass"] = int32(7)
+		systemdTimings := &SystemdTimings{IncludeServiceProperties: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if len(acc.Errors) != 1 {
+			t.Errorf("expected 1 error, got %d\n", len(acc.Errors))
+		}
+
+		if acc.HasField(measurement, "IOSchedulerClass") {
+			t.Errorf("unexpected IOSchedulerClass field\n")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newMockConn()
+		conn.unitProps["foo.service"]["Service.IOSchedulingClass"] = int32(1)
+		systemdTimings := &SystemdTimings{}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "IOSchedulerClass") {
+			t.Errorf("unexpected IOSchedulerClass field\n")
+		}
+	})
+}
+
+// addMockSocket adds a started socket unit to the mock connection.
+func addMockSocket(conn *mockConn, passCredentials bool) {
+	addMockUnit(conn, "foo.socket")
+	conn.unitProps["foo.socket"]["Socket.PassCredentials"] = passCredentials
+}
+
+func TestSocketPassCredentials(t *testing.T) {
+	for _, passCredentials := range []bool{true, false} {
+		t.Run(fmt.Sprintf("%t", passCredentials), func(t *testing.T) {
+			conn := newMockConn()
+			addMockSocket(conn, passCredentials)
+			systemdTimings := &SystemdTimings{IncludeSocketProperties: true}
+			acc := new(testutil.Accumulator)
+			collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+			if len(acc.Errors) != 0 {
+				t.Errorf("unexpected errors: %v\n", acc.Errors)
+			}
+
+			acc.AssertContainsTaggedFields(t, measurement,
+				map[string]interface{}{
+					"ActivatingTimestamp":   uint64(500),
+					"ActivatedTimestamp":    uint64(600),
+					"DeactivatingTimestamp": uint64(0),
+					"DeactivatedTimestamp":  uint64(0),
+					"RunDuration":           uint64(100),
+					"SocketPassCredentials": passCredentials,
+				},
+				map[string]string{"UnitName": "foo.socket"})
+
+			// Only socket units carry the field.
+			acc.AssertContainsTaggedFields(t, measurement,
+				map[string]interface{}{
+					"ActivatingTimestamp":   uint64(1000),
+					"ActivatedTimestamp":    uint64(2500),
+					"DeactivatingTimestamp": uint64(0),
+					"DeactivatedTimestamp":  uint64(0),
+					"RunDuration":           uint64(1500),
+				},
+				map[string]string{"UnitName": "foo.service"})
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newMockConn()
+		addMockSocket(conn, true)
+		systemdTimings := &SystemdTimings{}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "SocketPassCredentials") {
+			t.Errorf("unexpected SocketPassCredentials field\n")
+		}
+	})
+}
+
+// addMockUnit adds a started unit to the mock connection.
+func addMockUnit(conn *mockConn, unitName string) {
+	conn.unitProps[unitName] = map[string]interface{}{
+		"InactiveExitTimestampMonotonic":  uint64(1500),
+		"ActiveEnterTimestampMonotonic":   uint64(1600),
+		"ActiveExitTimestampMonotonic":    uint64(0),
+		"InactiveEnterTimestampMonotonic": uint64(0),
+	}
+}
+
+func TestHasAutomount(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		conn := newMockConn()
+		addMockUnit(conn, "mnt-data.mount")
+		addMockUnit(conn, "mnt-data.automount")
+		addMockUnit(conn, "boot.mount")
+		systemdTimings := &SystemdTimings{CollectMountDetails: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		expected := map[string]bool{
+			"mnt-data.mount": true,
+			"boot.mount":     false,
+		}
+
+		for _, metric := range acc.Metrics {
+			unitName := metric.Tags["UnitName"]
+			hasAutomount, found := metric.Fields["HasAutomount"]
+			if want, isMount := expected[unitName]; isMount {
+				if !found {
+					t.Errorf("HasAutomount not found for %s\n", unitName)
+				} else if hasAutomount != want {
+					t.Errorf("expected HasAutomount %t for %s, got %v\n",
+						want, unitName, hasAutomount)
+				}
+
+				delete(expected, unitName)
+			} else if found {
+				t.Errorf("unexpected HasAutomount field for %s\n", unitName)
+			}
+		}
+
+		for unitName := range expected {
+			t.Errorf("no metric for %s\n", unitName)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newMockConn()
+		addMockUnit(conn, "mnt-data.mount")
+		addMockUnit(conn, "mnt-data.automount")
+		systemdTimings := &SystemdTimings{}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "HasAutomount") {
+			t.Errorf("unexpected HasAutomount field\n")
+		}
+	})
+}
+
+// setMockReload sets the ExecReload property of foo.service to a single
+// reload command which finished at the monotonic timestamp exited.
+func setMockReload(conn *mockConn, exited uint64) {
+	conn.unitProps["foo.service"]["Service.ExecReload"] = [][]interface{}{
+		{
+			"/bin/kill", []string{"/bin/kill", "-HUP", "1234"}, false,
+			uint64(0), uint64(0), uint64(0), exited,
+			uint32(1235), int32(1), int32(0),
+		},
+	}
+}
+
+func TestLastReloadTimestamp(t *testing.T) {
+	t.Run("changes", func(t *testing.T) {
+		conn := newMockConn()
+		systemdTimings := &SystemdTimings{
+			Periodic:          true,
+			TrackStateChanges: true,
+		}
+
+		collections := []struct {
+			name     string
+			exited   uint64
+			expected uint64
+			found    bool
+		}{
+			{"never reloaded", 0, 0, false},
+			{"reloaded", 5000, 4000, true},
+			{"unchanged", 5000, 0, false},
+			{"reloaded again", 8000, 7000, true},
+		}
+
+		for _, collection := range collections {
+			setMockReload(conn, collection.exited)
+			acc := new(testutil.Accumulator)
+			collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+			if len(acc.Errors) != 0 {
+				t.Errorf("%s: unexpected errors: %v\n", collection.name,
+					acc.Errors)
+			}
+
+			reloaded, found := acc.Uint64Field(measurement,
+				"LastReloadTimestampUSec")
+			if found != collection.found {
+				t.Errorf("%s: expected LastReloadTimestampUSec found %t, "+
+					"got %t\n", collection.name, collection.found, found)
+			} else if reloaded != collection.expected {
+				t.Errorf("%s: expected LastReloadTimestampUSec %d, got %d\n",
+					collection.name, collection.expected, reloaded)
+			}
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		conn := newMockConn()
+		setMockReload(conn, 5000)
+		systemdTimings := &SystemdTimings{
+			Periodic:          true,
+			TrackStateChanges: true,
+		}
+
+		deliveries := []struct {
+			name      string
+			delivered bool
+			found     bool
+		}{
+			{"rejected", false, true},
+			{"retried", true, true},
+			{"delivered", true, false},
+		}
+
+		acc := newTrackingAccumulator()
+		for _, delivery := range deliveries {
+			acc.ClearMetrics()
+			collect(t, systemdTimings, conn, acc)
+
+			reloaded, found := acc.Uint64Field(measurement,
+				"LastReloadTimestampUSec")
+			if found != delivery.found {
+				t.Errorf("%s: expected LastReloadTimestampUSec found %t, "+
+					"got %t\n", delivery.name, delivery.found, found)
+			} else if found && reloaded != 4000 {
+				t.Errorf("%s: expected LastReloadTimestampUSec 4000, got %d\n",
+					delivery.name, reloaded)
+			}
+
+			acc.confirm(delivery.delivered)
+			systemdTimings.readDeliveries(acc)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		conn := newMockConn()
+		setMockReload(conn, 5000)
+		systemdTimings := &SystemdTimings{Periodic: true}
+		acc := new(testutil.Accumulator)
+		collect(t, systemdTimings, conn, untrackedAccumulator{acc})
+
+		if acc.HasField(measurement, "LastReloadTimestampUSec") {
+			t.Errorf("unexpected LastReloadTimestampUSec field\n")
+		}
+	})
+}